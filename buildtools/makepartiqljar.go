@@ -5,6 +5,8 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -13,11 +15,24 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+
+	"github.com/cheggaaa/pb/v3"
 )
 
 const partiqlURLTemplate = "https://github.com/partiql/partiql-lang-kotlin/releases/download/v%s-alpha/partiql-cli-%s.tgz"
 
+// cacheDirName is the subdirectory of the user cache dir (respecting
+// $XDG_CACHE_HOME on Linux; see os.UserCacheDir) where downloaded release
+// tarballs are kept so repeated invocations don't re-download them.
+const cacheDirName = "partiqldemo"
+
+// knownSHA256 pins the sha256 of release tarballs we've verified by hand, used
+// when --sha256 isn't passed explicitly. Empty for a version means the
+// download isn't verified unless the caller supplies --sha256.
+var knownSHA256 = map[string]string{}
+
 var includedJarPrefixes = []string{
 	"cli",
 	"jopt-simple",
@@ -44,20 +59,145 @@ func isIncludedJar(filePath string) bool {
 	return false
 }
 
-func httpUntarToJar(url string, jarW *jarWriter) error {
-	resp, err := http.Get(url)
+// cachePathFor returns where fetchTarball caches the tarball downloaded from
+// sourceURL for version, creating its parent directory if needed. The cache
+// key includes a hash of sourceURL (not just version) so pointing --url at a
+// mirror or a local file:// build doesn't collide with a cached copy of the
+// real GitHub release for the same version.
+func cachePathFor(sourceURL string, version string) (string, error) {
+	base, err := os.UserCacheDir()
 	if err != nil {
-		return err
+		return "", err
+	}
+	dir := filepath.Join(base, cacheDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	urlHash := sha256.Sum256([]byte(sourceURL))
+	return filepath.Join(dir, fmt.Sprintf("partiql-cli-%s-%s.tgz", version, hex.EncodeToString(urlHash[:8]))), nil
+}
+
+// sha256File computes the hex sha256 digest of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	if !(200 <= resp.StatusCode && resp.StatusCode < 300) {
-		return fmt.Errorf("unexpected status=%s", resp.Status)
+// fetchTarball returns the path to a local copy of the PartiQL CLI release
+// tarball at sourceURL, downloading it only if it isn't already cached for
+// this exact (sourceURL, version) pair. sourceURL may be an http(s) URL or a
+// file:// path, letting callers point at a mirror or a local copy via --url.
+// If expectedSHA256 is non-empty
+// (explicitly, or via knownSHA256), the tarball is verified against it before
+// being used; a cached file that fails verification is deleted and
+// re-fetched. Unless quiet is set, download progress is reported on stderr.
+func fetchTarball(sourceURL string, version string, expectedSHA256 string, quiet bool) (string, error) {
+	if expectedSHA256 == "" {
+		expectedSHA256 = knownSHA256[version]
 	}
 
-	unzipped, err := gzip.NewReader(resp.Body)
+	cachePath, err := cachePathFor(sourceURL, version)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if _, statErr := os.Stat(cachePath); statErr == nil {
+		if expectedSHA256 == "" {
+			log.Printf("using cached %s (unverified)", cachePath)
+			return cachePath, nil
+		}
+		got, sumErr := sha256File(cachePath)
+		if sumErr == nil && strings.EqualFold(got, expectedSHA256) {
+			log.Printf("using cached %s", cachePath)
+			return cachePath, nil
+		}
+		log.Printf("cached %s failed checksum verification, re-downloading", cachePath)
+		if rmErr := os.Remove(cachePath); rmErr != nil {
+			return "", rmErr
+		}
+	}
+
+	var body io.ReadCloser
+	var size int64
+	if localPath := strings.TrimPrefix(sourceURL, "file://"); localPath != sourceURL {
+		f, err := os.Open(localPath)
+		if err != nil {
+			return "", err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return "", err
+		}
+		body, size = f, info.Size()
+	} else {
+		resp, err := http.Get(sourceURL)
+		if err != nil {
+			return "", err
+		}
+		if !(200 <= resp.StatusCode && resp.StatusCode < 300) {
+			resp.Body.Close()
+			return "", fmt.Errorf("unexpected status=%s", resp.Status)
+		}
+		body, size = resp.Body, resp.ContentLength
+	}
+	defer body.Close()
+
+	var reader io.Reader = body
+	if !quiet {
+		bar := pb.Full.Start64(size)
+		bar.Set(pb.Bytes, true)
+		reader = bar.NewProxyReader(body)
+		defer bar.Finish()
+	}
+
+	tmpPath := cachePath + ".tmp"
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	_, copyErr := io.Copy(out, io.TeeReader(reader, hasher))
+	closeErr := out.Close()
+	if copyErr != nil {
+		os.Remove(tmpPath)
+		return "", copyErr
+	}
+	if closeErr != nil {
+		os.Remove(tmpPath)
+		return "", closeErr
+	}
+
+	if expectedSHA256 != "" {
+		got := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(got, expectedSHA256) {
+			os.Remove(tmpPath)
+			return "", fmt.Errorf("checksum mismatch for %s: got %s, want %s", sourceURL, got, expectedSHA256)
+		}
+	}
+
+	if err := os.Rename(tmpPath, cachePath); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	return cachePath, nil
+}
+
+// untarToJar reads r as a gzipped tar of the PartiQL CLI release and combines
+// the jars matching includedJarPrefixes into jarW. It returns the names of
+// the jars it included and skipped, for the caller's summary line.
+func untarToJar(r io.Reader, jarW *jarWriter) (included []string, skipped []string, err error) {
+	unzipped, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
 	}
 	defer unzipped.Close()
 
@@ -68,7 +208,7 @@ func httpUntarToJar(url string, jarW *jarWriter) error {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return included, skipped, err
 		}
 
 		if !header.FileInfo().Mode().IsRegular() {
@@ -79,21 +219,16 @@ func httpUntarToJar(url string, jarW *jarWriter) error {
 		}
 
 		if isIncludedJar(header.Name) {
-			fmt.Printf("jar name=%s is being included ...\n", header.Name)
-			err = combineJar(jarW, reader)
-			if err != nil {
-				return err
+			if err := combineJar(jarW, reader); err != nil {
+				return included, skipped, err
 			}
+			included = append(included, header.Name)
 		} else {
-			fmt.Printf("jar name=%s is not included\n", header.Name)
+			skipped = append(skipped, header.Name)
 		}
 	}
 
-	err = unzipped.Close()
-	if err != nil {
-		return err
-	}
-	return resp.Body.Close()
+	return included, skipped, unzipped.Close()
 }
 
 type jarWriter struct {
@@ -154,6 +289,9 @@ func combineJar(jarW *jarWriter, jarReader io.Reader) error {
 func main() {
 	version := flag.String("version", "0.2.4", "PartiQL version to download")
 	outputPath := flag.String("outputPath", "", "Path to write the combined jar")
+	quiet := flag.Bool("quiet", false, "Suppress the download progress bar (e.g. when running in CI)")
+	url := flag.String("url", "", "Override the download URL (http(s):// or file://); defaults to the GitHub release for --version")
+	sha256Hex := flag.String("sha256", "", "Expected sha256 of the downloaded tarball; verified before use")
 	flag.Parse()
 	if *outputPath == "" {
 		fmt.Fprintln(os.Stderr, "Usage: combinejars --outputPath=(path to output JAR)")
@@ -170,12 +308,29 @@ func main() {
 
 	jarW := &jarWriter{zw, make(map[string]struct{})}
 
-	partiqlURL := fmt.Sprintf(partiqlURLTemplate, *version, *version)
-	log.Printf("downloading PartiQL version=%s from %s ...", *version, partiqlURL)
-	err = httpUntarToJar(partiqlURL, jarW)
+	partiqlURL := *url
+	if partiqlURL == "" {
+		partiqlURL = fmt.Sprintf(partiqlURLTemplate, *version, *version)
+	}
+	log.Printf("fetching PartiQL version=%s from %s ...", *version, partiqlURL)
+	tarballPath, err := fetchTarball(partiqlURL, *version, *sha256Hex, *quiet)
+	if err != nil {
+		panic(err)
+	}
+
+	tarball, err := os.Open(tarballPath)
 	if err != nil {
 		panic(err)
 	}
+	included, skipped, err := untarToJar(tarball, jarW)
+	closeErr := tarball.Close()
+	if err != nil {
+		panic(err)
+	}
+	if closeErr != nil {
+		panic(closeErr)
+	}
+
 	err = zw.Close()
 	if err != nil {
 		panic(err)
@@ -184,4 +339,11 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+
+	outputInfo, err := os.Stat(*outputPath)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("combined %d jars (skipped %d) into %s (%d bytes)\n",
+		len(included), len(skipped), *outputPath, outputInfo.Size())
 }
@@ -0,0 +1,190 @@
+// Package history records executed queries to a local SQLite database so the
+// demo can offer a /history page, permalinks, and a small REST surface
+// without pulling in an external datastore.
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const driverName = "sqlite"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS history (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	query       TEXT NOT NULL,
+	environment TEXT NOT NULL,
+	result      TEXT NOT NULL,
+	elapsed_ms  INTEGER NOT NULL,
+	remote_addr TEXT NOT NULL,
+	created_at  TIMESTAMP NOT NULL,
+	saved       INTEGER NOT NULL DEFAULT 0,
+	name        TEXT NOT NULL DEFAULT ''
+);
+`
+
+// Entry is one recorded execution. Saved entries (Saved=true, with a
+// user-chosen Name) are exempt from the size-cap trimming that Store.Record
+// otherwise applies to the oldest rows.
+type Entry struct {
+	ID          int64     `json:"id"`
+	Query       string    `json:"query"`
+	Environment string    `json:"environment"`
+	Result      string    `json:"result"`
+	ElapsedMs   int64     `json:"elapsedMs"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Saved       bool      `json:"saved"`
+	Name        string    `json:"name,omitempty"`
+}
+
+// Store is a SQLite-backed history of executed queries. A Store is safe for
+// concurrent use by multiple goroutines, same as the *sql.DB it wraps.
+type Store struct {
+	db      *sql.DB
+	maxRows int
+}
+
+// Open opens (creating if necessary) the SQLite database at path and
+// prepares its schema. maxRows bounds how many un-saved rows Record keeps;
+// the oldest un-saved rows beyond that are trimmed after every insert. A
+// maxRows of 0 or less disables trimming.
+func Open(path string, maxRows int) (*Store, error) {
+	// SQLite allows only one writer at a time; WAL mode lets reads proceed
+	// concurrently with a writer, and the busy timeout makes the rest queue
+	// instead of immediately failing with SQLITE_BUSY. Record and the
+	// /history handlers are called from every concurrent query through the
+	// worker pool, so both matter here.
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)", path)
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// modernc.org/sqlite has no internal connection lock: concurrent writer
+	// connections still race for the single database-level write lock and
+	// surface it as SQLITE_BUSY. Limiting to one connection serializes
+	// writes in the pool instead, with the busy timeout covering the rest.
+	// Within this process reads are serialized along with the writes, so
+	// WAL's concurrent reads only apply to other connections to the file.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, maxRows: maxRows}, nil
+}
+
+// Close closes the underlying database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Record inserts e (ignoring e.ID, which is assigned by the database) and
+// returns its new ID, then trims the oldest un-saved rows beyond maxRows.
+func (s *Store) Record(ctx context.Context, e Entry) (int64, error) {
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO history (query, environment, result, elapsed_ms, remote_addr, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		e.Query, e.Environment, e.Result, e.ElapsedMs, e.RemoteAddr, e.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.trim(ctx); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// trim deletes the oldest un-saved rows beyond maxRows. It is a no-op if
+// maxRows is 0 or less.
+func (s *Store) trim(ctx context.Context) error {
+	if s.maxRows <= 0 {
+		return nil
+	}
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM history WHERE saved = 0 AND id NOT IN (
+			SELECT id FROM history WHERE saved = 0 ORDER BY id DESC LIMIT ?
+		)`, s.maxRows)
+	return err
+}
+
+// List returns the most recent entries, newest first, up to limit.
+func (s *Store) List(ctx context.Context, limit int) ([]Entry, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, query, environment, result, elapsed_ms, remote_addr, created_at, saved, name
+		 FROM history ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var saved int
+		if err := rows.Scan(&e.ID, &e.Query, &e.Environment, &e.Result, &e.ElapsedMs,
+			&e.RemoteAddr, &e.CreatedAt, &saved, &e.Name); err != nil {
+			return nil, err
+		}
+		e.Saved = saved != 0
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Get returns the entry with the given id.
+func (s *Store) Get(ctx context.Context, id int64) (Entry, error) {
+	var e Entry
+	var saved int
+	row := s.db.QueryRowContext(ctx,
+		`SELECT id, query, environment, result, elapsed_ms, remote_addr, created_at, saved, name
+		 FROM history WHERE id = ?`, id)
+	if err := row.Scan(&e.ID, &e.Query, &e.Environment, &e.Result, &e.ElapsedMs,
+		&e.RemoteAddr, &e.CreatedAt, &saved, &e.Name); err != nil {
+		return Entry{}, err
+	}
+	e.Saved = saved != 0
+	return e, nil
+}
+
+// Delete removes the entry with the given id.
+func (s *Store) Delete(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM history WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("history: no entry with id %d", id)
+	}
+	return nil
+}
+
+// Save marks the entry with the given id as saved under name, exempting it
+// from the size-cap trimming Record otherwise applies.
+func (s *Store) Save(ctx context.Context, id int64, name string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE history SET saved = 1, name = ? WHERE id = ?`, name, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("history: no entry with id %d", id)
+	}
+	return nil
+}
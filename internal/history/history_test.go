@@ -0,0 +1,170 @@
+package history
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, maxRows int) *Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "history.db")
+	s, err := Open(path, maxRows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStoreRecordListGet(t *testing.T) {
+	s := openTestStore(t, 0)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	id, err := s.Record(ctx, Entry{
+		Query:       "SELECT 1",
+		Environment: "{}",
+		Result:      "1",
+		ElapsedMs:   5,
+		RemoteAddr:  "127.0.0.1",
+		CreatedAt:   now,
+	})
+	if err != nil {
+		t.Fatalf("Record: %s", err)
+	}
+	if id == 0 {
+		t.Fatal("Record returned id 0")
+	}
+
+	got, err := s.Get(ctx, id)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if got.Query != "SELECT 1" || got.Result != "1" || got.ElapsedMs != 5 {
+		t.Errorf("Get returned %+v", got)
+	}
+	if !got.CreatedAt.Equal(now) {
+		t.Errorf("CreatedAt = %s, want %s", got.CreatedAt, now)
+	}
+	if got.Saved {
+		t.Error("a freshly recorded entry should not be Saved")
+	}
+
+	entries, err := s.List(ctx, 10)
+	if err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	if len(entries) != 1 || entries[0].ID != id {
+		t.Errorf("List = %+v, want one entry with id %d", entries, id)
+	}
+}
+
+func TestStoreListNewestFirst(t *testing.T) {
+	s := openTestStore(t, 0)
+	ctx := context.Background()
+
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		id, err := s.Record(ctx, Entry{Query: "q", Environment: "{}", Result: "r", CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	entries, err := s.List(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("List returned %d entries, want 3", len(entries))
+	}
+	for i, e := range entries {
+		want := ids[len(ids)-1-i]
+		if e.ID != want {
+			t.Errorf("entries[%d].ID = %d, want %d (newest first)", i, e.ID, want)
+		}
+	}
+}
+
+func TestStoreRecordTrimsUnsavedPastMaxRows(t *testing.T) {
+	s := openTestStore(t, 2)
+	ctx := context.Background()
+
+	var ids []int64
+	for i := 0; i < 4; i++ {
+		id, err := s.Record(ctx, Entry{Query: "q", Environment: "{}", Result: "r", CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	entries, err := s.List(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("List returned %d entries, want 2 (trimmed to maxRows)", len(entries))
+	}
+	// the two most recently recorded should survive
+	if entries[0].ID != ids[3] || entries[1].ID != ids[2] {
+		t.Errorf("surviving entries = %+v, want ids %d and %d", entries, ids[3], ids[2])
+	}
+}
+
+func TestStoreSaveExemptsFromTrim(t *testing.T) {
+	s := openTestStore(t, 1)
+	ctx := context.Background()
+
+	savedID, err := s.Record(ctx, Entry{Query: "keep me", Environment: "{}", Result: "r", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx, savedID, "my snippet"); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+
+	// record enough new un-saved entries to push savedID past maxRows=1
+	for i := 0; i < 3; i++ {
+		if _, err := s.Record(ctx, Entry{Query: "q", Environment: "{}", Result: "r", CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.Get(ctx, savedID)
+	if err != nil {
+		t.Fatalf("saved entry was trimmed: %s", err)
+	}
+	if !got.Saved || got.Name != "my snippet" {
+		t.Errorf("Get(savedID) = %+v, want Saved=true Name=%q", got, "my snippet")
+	}
+}
+
+func TestStoreDeleteAndNotFound(t *testing.T) {
+	s := openTestStore(t, 0)
+	ctx := context.Background()
+
+	id, err := s.Record(ctx, Entry{Query: "q", Environment: "{}", Result: "r", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := s.Get(ctx, id); err == nil {
+		t.Error("Get after Delete should fail")
+	}
+
+	if err := s.Delete(ctx, id); err == nil {
+		t.Error("Delete of an already-deleted id should report an error")
+	}
+	if err := s.Save(ctx, 999999, "name"); err == nil {
+		t.Error("Save of an unknown id should report an error")
+	}
+	if _, err := s.Get(ctx, 999999); err == nil {
+		t.Error("Get of an unknown id should report an error")
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
-	"encoding/binary"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -11,7 +14,19 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/evanj/partiqldemo/internal/history"
 )
 
 const portEnvVar = "PORT"
@@ -20,8 +35,127 @@ const executePath = "/execute"
 const envFormID = "env"
 const queryFormID = "query"
 const mainClass = "org.partiql.cli.Main"
+const outputFormatFormID = "outputFormat"
+const defaultOutputFormat = "PARTIQL"
+
+// supportedOutputFormats populates the outputFormat dropdown on the HTML
+// form. The submitted format is passed straight through to the CLI's
+// --output-format flag (or the equivalent server-mode option); it is not
+// checked against this list.
+var supportedOutputFormats = []string{"PARTIQL", "JSON", "ION", "CSV"}
+
+// contentTypeForOutputFormat is the Content-Type of the HTML page's "download
+// results" link for the given output format.
+func contentTypeForOutputFormat(format string) string {
+	switch format {
+	case "JSON":
+		return "application/json"
+	case "ION":
+		return "application/x-amzn-ion"
+	case "CSV":
+		return "text/csv"
+	default:
+		return "text/plain"
+	}
+}
+
+// defaultQueryTimeout bounds how long a single query may run before its java
+// child is killed; see the -queryTimeout flag.
+const defaultQueryTimeout = 30 * time.Second
+
+// sigtermGracePeriod is how long a killed java child is given to exit after
+// SIGTERM before exec escalates to SIGKILL (via exec.Cmd.WaitDelay).
+const sigtermGracePeriod = 5 * time.Second
+
+// apiExecutePath is the JSON equivalent of executePath: POST a JSON body here,
+// or POST to executePath with an "Accept: application/json" header, to get a
+// JSON response instead of the rendered HTML page.
+const apiExecutePath = "/api/execute"
+
+// executeJSONPath lets tools drive the demo without scraping HTML: POST
+// {query, environment, format} here and get back {result, format, elapsed_ms,
+// error}.
+const executeJSONPath = "/execute.json"
+
+// defaultMaxRequestBodyBytes bounds the size of JSON API request bodies; see
+// the -maxRequestBodyBytes flag.
+const defaultMaxRequestBodyBytes = 1 << 20 // 1 MiB
+
+// defaultHistoryMaxRows bounds how many un-saved history rows are kept; see
+// the -historyMaxRows flag.
+const defaultHistoryMaxRows = 1000
+
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "partiql_queries_total",
+		Help: "Total number of queries executed, by outcome status.",
+	}, []string{"status"})
+
+	queryDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "partiql_query_duration_seconds",
+		Help:    "Time the PartiQL backend took to execute a query.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	queriesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "partiql_queries_in_flight",
+		Help: "Number of queries currently executing.",
+	})
+
+	queryBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "partiql_query_bytes",
+		Help:    "Size in bytes of the submitted query text.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 8),
+	})
+
+	environmentBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "partiql_environment_bytes",
+		Help:    "Size in bytes of the submitted environment data.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 8),
+	})
+
+	queriesFailedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "partiql_queries_failed_total",
+		Help: "Total number of queries that did not complete successfully.",
+	})
+
+	workerRestartsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "partiql_worker_restarts_total",
+		Help: "Total number of times a pool worker was killed and a replacement JVM started.",
+	})
+)
+
+// classifyError buckets an executeAndRender error for the partiql_queries_total
+// counter: "success", a client/deadline "timeout", a failure to even launch
+// the JVM ("exec_failure"), or a PartiQL parse/eval error reported by the CLI
+// via a non-zero exit code ("query_error").
+func classifyError(err error) string {
+	if err == nil {
+		return "success"
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return "timeout"
+	}
+	var execErr *exec.Error
+	if errors.As(err, &execErr) {
+		return "exec_failure"
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "query_error"
+	}
+	var perr *partiqlError
+	if errors.As(err, &perr) {
+		return "query_error"
+	}
+	return "exec_failure"
+}
+
+func writeTemp(ctx context.Context, data string) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-func writeTemp(data string) (*os.File, error) {
 	tempFile, err := ioutil.TempFile("", "")
 	if err != nil {
 		return nil, err
@@ -56,9 +190,9 @@ func (q *queryExecError) Unwrap() error {
 // executeOriginalCLI executes the upstream org.partiql.cli.Main class. Use this function
 // to use the unmodified upstream distribution. As of the most recent release, its output
 // format is not quite as nice.
-func executeOriginalCLI(classpath string, query string, environment string) (string, error) {
+func executeOriginalCLI(ctx context.Context, classpath string, query string, environment string, outputFormat string) (string, error) {
 	// write the environment data to a temporary file
-	tempFile, err := writeTemp(environment)
+	tempFile, err := writeTemp(ctx, environment)
 	if err != nil {
 		return "", err
 	}
@@ -69,9 +203,11 @@ func executeOriginalCLI(classpath string, query string, environment string) (str
 	if classpath != "" {
 		args = append(args, "-classpath", classpath)
 	}
-	args = append(args, mainClass, "--environment", tempFile.Name(), "--output-format", "PARTIQL",
+	args = append(args, mainClass, "--environment", tempFile.Name(), "--output-format", outputFormat,
 		"--query", query)
-	cmd := exec.Command("java", args...)
+	cmd := exec.CommandContext(ctx, "java", args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = sigtermGracePeriod
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", &queryExecError{out, err}
@@ -80,16 +216,18 @@ func executeOriginalCLI(classpath string, query string, environment string) (str
 	return string(out), nil
 }
 
-func executeNewCLI(jar string, query string, environment string) (string, error) {
+func executeNewCLI(ctx context.Context, jar string, query string, environment string, outputFormat string) (string, error) {
 	// write the environment data to a temporary file
-	tempFile, err := writeTemp(environment)
+	tempFile, err := writeTemp(ctx, environment)
 	if err != nil {
 		return "", err
 	}
 	defer os.Remove(tempFile.Name())
 
 	// execute the new CLI
-	cmd := exec.Command("java", "-jar", jar, tempFile.Name())
+	cmd := exec.CommandContext(ctx, "java", "-jar", jar, "--output-format", outputFormat, tempFile.Name())
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = sigtermGracePeriod
 
 	// write the query on stdin in a separate goroutine
 	stdin, err := cmd.StdinPipe()
@@ -121,10 +259,62 @@ func executeNewCLI(jar string, query string, environment string) (string, error)
 	return string(out), nil
 }
 
+// jsonRequest is one line written to a javaServerConnection's stdin. id
+// correlates it with the jsonResponse line of the same id, which may arrive
+// out of order relative to other in-flight requests.
+type jsonRequest struct {
+	ID          int64             `json:"id"`
+	Type        string            `json:"type,omitempty"` // "" (execute) or "ping"
+	Query       string            `json:"query,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Options     map[string]string `json:"options,omitempty"`
+}
+
+// jsonResponse is one line read from a javaServerConnection's stdout.
+type jsonResponse struct {
+	ID     int64  `json:"id"`
+	OK     bool   `json:"ok"`
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Stage  string `json:"stage,omitempty"` // "parse", "compile", or "eval"
+}
+
+// partiqlError is a query that reached the JVM and failed there (bad syntax,
+// a type error, ...), as opposed to a transport-level failure. The
+// distinction matters to connectionPool: a partiqlError means the connection
+// itself is still healthy and can serve the next request.
+type partiqlError struct {
+	stage   string
+	message string
+}
+
+func (e *partiqlError) Error() string {
+	if e.stage == "" {
+		return e.message
+	}
+	return fmt.Sprintf("%s error: %s", e.stage, e.message)
+}
+
+// maxResponseLineBytes bounds how large a single jsonResponse line may be;
+// PartiQL results can be large, so this is generous.
+const maxResponseLineBytes = 16 << 20 // 16 MiB
+
 type javaServerConnection struct {
 	process     *exec.Cmd
 	fromProcess io.ReadCloser
 	toProcess   io.WriteCloser
+
+	nextID int64 // accessed atomically
+
+	// consecutiveHealthCheckFailures counts failed pings since the last
+	// success, accessed atomically. healthCheckLoop tolerates a few in a
+	// row (transient GC pauses etc.) before recycling the worker.
+	consecutiveHealthCheckFailures int32
+
+	writeMu sync.Mutex // serializes writes to toProcess
+
+	mu      sync.Mutex
+	pending map[int64]chan jsonResponse // nil once the connection has died
 }
 
 func newJavaServerConnection(jarPath string) (*javaServerConnection, error) {
@@ -145,7 +335,147 @@ func newJavaServerConnection(jarPath string) (*javaServerConnection, error) {
 		stdout.Close()
 		return nil, err
 	}
-	return &javaServerConnection{process, stdout, stdin}, nil
+
+	j := &javaServerConnection{
+		process:     process,
+		fromProcess: stdout,
+		toProcess:   stdin,
+		pending:     make(map[int64]chan jsonResponse),
+	}
+	go j.readLoop()
+	return j, nil
+}
+
+// readLoop demultiplexes response lines to the channel waiting on each one,
+// until the process's stdout closes (graceful exit or crash), at which point
+// every still-pending request is failed.
+func (j *javaServerConnection) readLoop() {
+	scanner := bufio.NewScanner(j.fromProcess)
+	scanner.Buffer(make([]byte, 64*1024), maxResponseLineBytes)
+	for scanner.Scan() {
+		var resp jsonResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			log.Printf("warning: could not parse response line: %s", err.Error())
+			continue
+		}
+		j.deliver(resp)
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	j.failPending(err)
+}
+
+func (j *javaServerConnection) deliver(resp jsonResponse) {
+	j.mu.Lock()
+	ch, ok := j.pending[resp.ID]
+	if ok {
+		delete(j.pending, resp.ID)
+	}
+	j.mu.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+// failPending marks the connection dead and delivers err to every request
+// still waiting on a reply.
+func (j *javaServerConnection) failPending(err error) {
+	j.mu.Lock()
+	pending := j.pending
+	j.pending = nil
+	j.mu.Unlock()
+
+	for id, ch := range pending {
+		ch <- jsonResponse{ID: id, OK: false, Error: err.Error()}
+	}
+}
+
+// writeWithDeadline writes line to the process's stdin, but gives up as soon
+// as ctx is done even if the Write call itself is still blocked (e.g. the JVM
+// has stopped reading stdin and the pipe buffer is full). io.WriteCloser
+// doesn't expose a deadline the way net.Conn does, so this races the Write
+// against ctx in a goroutine instead. On a ctx-driven abandonment the
+// connection is poisoned: the write may still land later, so it must not be
+// handed another request while that's possible.
+func (j *javaServerConnection) writeWithDeadline(ctx context.Context, line []byte) error {
+	done := make(chan error, 1)
+	go func() {
+		j.writeMu.Lock()
+		_, err := j.toProcess.Write(line)
+		j.writeMu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		j.poison(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// poison marks the connection unusable for any future request, failing
+// anything still waiting on a reply. It's used when a write is abandoned
+// mid-flight, since the abandoned write (and the reply it elicits) may still
+// land on the pipe later and must not be mistaken for a fresh request's.
+func (j *javaServerConnection) poison(cause error) {
+	j.failPending(cause)
+}
+
+// send writes req as a single JSON line and waits for its matching response,
+// honoring ctx for cancellation while waiting.
+func (j *javaServerConnection) send(ctx context.Context, req jsonRequest) (jsonResponse, error) {
+	respCh := make(chan jsonResponse, 1)
+
+	j.mu.Lock()
+	if j.pending == nil {
+		j.mu.Unlock()
+		return jsonResponse{}, errors.New("javaServerConnection is closed")
+	}
+	j.pending[req.ID] = respCh
+	j.mu.Unlock()
+
+	line, err := json.Marshal(req)
+	if err != nil {
+		j.mu.Lock()
+		delete(j.pending, req.ID)
+		j.mu.Unlock()
+		return jsonResponse{}, err
+	}
+	line = append(line, '\n')
+
+	if err := j.writeWithDeadline(ctx, line); err != nil {
+		j.mu.Lock()
+		delete(j.pending, req.ID)
+		j.mu.Unlock()
+		return jsonResponse{}, err
+	}
+
+	select {
+	case resp := <-respCh:
+		if !resp.OK {
+			// failPending reports a dead connection as a not-OK response;
+			// return that as a transport error, not a JVM-reported one.
+			j.mu.Lock()
+			dead := j.pending == nil
+			j.mu.Unlock()
+			if dead {
+				return jsonResponse{}, errors.New(resp.Error)
+			}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		j.mu.Lock()
+		if j.pending != nil {
+			delete(j.pending, req.ID)
+		}
+		j.mu.Unlock()
+		return jsonResponse{}, ctx.Err()
+	}
 }
 
 func (j *javaServerConnection) close() error {
@@ -161,39 +491,218 @@ func (j *javaServerConnection) close() error {
 	return err3
 }
 
-func (j *javaServerConnection) execute(query string, environment string) (string, error) {
-	// write the length header, then the query/environment bytes
-	const int32Len = 4
-	header := make([]byte, int32Len*2)
-	binary.LittleEndian.PutUint32(header, uint32(len(query)))
-	binary.LittleEndian.PutUint32(header[int32Len:], uint32(len(environment)))
-	_, err := j.toProcess.Write(header)
-	if err != nil {
-		return "", err
+// kill forcibly terminates the underlying java process. It is used to abandon
+// a connection stuck on a runaway query; the connection must not be reused
+// afterwards since a reply may still be in flight on its pipes.
+func (j *javaServerConnection) kill() error {
+	if j.process.Process == nil {
+		return nil
+	}
+	return j.process.Process.Kill()
+}
+
+// alive reports whether the underlying java process is still running, without
+// blocking or consuming its exit status. It is a cheap pre-check before
+// ping; connectionPool's health check relies on ping for the real answer.
+func (j *javaServerConnection) alive() bool {
+	if j.process.Process == nil {
+		return false
 	}
+	return j.process.Process.Signal(syscall.Signal(0)) == nil
+}
 
-	_, err = j.toProcess.Write([]byte(query))
+// ping round-trips a trivial request through the connection to confirm the
+// JVM is actually responsive, not just alive. Used by connectionPool's
+// health check goroutine.
+func (j *javaServerConnection) ping(ctx context.Context) error {
+	id := atomic.AddInt64(&j.nextID, 1)
+	resp, err := j.send(ctx, jsonRequest{ID: id, Type: "ping"})
 	if err != nil {
-		return "", err
+		return err
 	}
-	_, err = j.toProcess.Write([]byte(environment))
-	if err != nil {
-		return "", err
+	if !resp.OK {
+		return &partiqlError{resp.Stage, resp.Error}
 	}
+	return nil
+}
 
-	// read the response length
-	_, err = io.ReadFull(j.fromProcess, header[:int32Len])
+func (j *javaServerConnection) execute(ctx context.Context, query string, environment string, outputFormat string) (string, error) {
+	id := atomic.AddInt64(&j.nextID, 1)
+	req := jsonRequest{ID: id, Query: query, Environment: environment}
+	if outputFormat != "" {
+		req.Options = map[string]string{"outputFormat": outputFormat}
+	}
+	resp, err := j.send(ctx, req)
 	if err != nil {
 		return "", err
 	}
-	respLen := binary.LittleEndian.Uint32(header[:int32Len])
-	log.Printf("reading response len=%d", respLen)
-	respBytes := make([]byte, respLen)
-	_, err = io.ReadFull(j.fromProcess, respBytes)
+	if !resp.OK {
+		return "", &partiqlError{resp.Stage, resp.Error}
+	}
+	return resp.Result, nil
+}
+
+// connectionHealthy reports whether err (from execute or ping) reflects a
+// normal query failure reported by the JVM, as opposed to a transport-level
+// problem that means the connection itself should be retired.
+func connectionHealthy(err error) bool {
+	if err == nil {
+		return true
+	}
+	var perr *partiqlError
+	return errors.As(err, &perr)
+}
+
+const healthCheckInterval = 15 * time.Second
+const restartInitialBackoff = 1 * time.Second
+const restartMaxBackoff = 30 * time.Second
+
+// connectionPool manages a fixed-size set of long-lived javaServerConnections so
+// that concurrent requests don't serialize behind a single JVM, and a crashed
+// worker doesn't take the whole server down with it.
+//
+// Workers are handed out and returned through a buffered channel: acquire
+// blocks (respecting the caller's context) when every worker is busy, which
+// gives the server natural back-pressure under load instead of an unbounded
+// queue of exec.Command calls.
+type connectionPool struct {
+	jarPath string
+	workers chan *javaServerConnection
+	size    int
+}
+
+// newConnectionPool starts size JVM workers for jarPath and returns once all of
+// them are ready to serve queries.
+func newConnectionPool(jarPath string, size int) (*connectionPool, error) {
+	p := &connectionPool{jarPath: jarPath, workers: make(chan *javaServerConnection, size), size: size}
+	for i := 0; i < size; i++ {
+		conn, err := newJavaServerConnection(jarPath)
+		if err != nil {
+			return nil, err
+		}
+		p.workers <- conn
+	}
+	go p.healthCheckLoop()
+	return p, nil
+}
+
+// acquire hands out an idle worker, blocking until one is free or ctx is done.
+func (p *connectionPool) acquire(ctx context.Context) (*javaServerConnection, error) {
+	select {
+	case conn := <-p.workers:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// release returns conn to the pool. If healthy is false, conn is assumed to be
+// in a bad state (e.g. the last query on it failed) and is replaced in the
+// background instead of being handed to the next caller.
+func (p *connectionPool) release(conn *javaServerConnection, healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&conn.consecutiveHealthCheckFailures, 0)
+		p.workers <- conn
+		return
+	}
+	go p.replace(conn)
+}
+
+// replace closes a bad connection and restarts it, retrying with exponential
+// backoff until a new JVM comes up, then returns it to the pool.
+func (p *connectionPool) replace(bad *javaServerConnection) {
+	if closeErr := bad.close(); closeErr != nil {
+		log.Printf("warning: error closing unhealthy server: %s", closeErr.Error())
+	}
+
+	backoff := restartInitialBackoff
+	for {
+		conn, err := newJavaServerConnection(p.jarPath)
+		if err == nil {
+			workerRestartsTotal.Inc()
+			p.workers <- conn
+			return
+		}
+		log.Printf("warning: error restarting server, retrying in %s: %s", backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > restartMaxBackoff {
+			backoff = restartMaxBackoff
+		}
+	}
+}
+
+// healthCheckPingTimeout caps each health check ping to a short timeout so a single
+// unresponsive worker doesn't stall the whole health check pass.
+const healthCheckPingTimeout = 5 * time.Second
+
+// maxConsecutiveHealthCheckFailures bounds how many failed pings in a row a
+// worker is allowed before healthCheckLoop recycles it. A single failed ping
+// is tolerated since it can just be a slow GC pause; this avoids churning
+// workers under load.
+const maxConsecutiveHealthCheckFailures = 3
+
+// healthCheckLoop periodically pulls an idle worker out of the pool and pings
+// it, replacing it if the process died or failed too many pings in a row.
+// This catches workers that crashed or hung while sitting idle, rather than
+// only on their next query.
+func (p *connectionPool) healthCheckLoop() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for i := 0; i < p.size; i++ {
+			select {
+			case conn := <-p.workers:
+				if !conn.alive() {
+					p.release(conn, false)
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), healthCheckPingTimeout)
+				err := conn.ping(ctx)
+				cancel()
+				if connectionHealthy(err) {
+					atomic.StoreInt32(&conn.consecutiveHealthCheckFailures, 0)
+					p.release(conn, true)
+					continue
+				}
+				failures := atomic.AddInt32(&conn.consecutiveHealthCheckFailures, 1)
+				if failures < maxConsecutiveHealthCheckFailures {
+					log.Printf("worker failed health check (%d/%d consecutive), keeping in rotation: %s",
+						failures, maxConsecutiveHealthCheckFailures, err)
+					p.workers <- conn
+					continue
+				}
+				log.Printf("worker failed %d consecutive health checks, recycling", failures)
+				p.release(conn, false)
+			default:
+				// every worker is currently checked out serving a query; nothing to do
+			}
+		}
+	}
+}
+
+// executeWithContext acquires a worker, runs the query, and returns it to the
+// pool. conn.execute returns as soon as ctx is done even if the JVM is still
+// working, so the caller (and this reserved slot) is never stuck behind a
+// runaway query. A normal PartiQL error leaves the connection in the pool for
+// the next caller; a transport-level failure closes the worker, and ctx
+// expiring kills it, and either way it is replaced in the background.
+func (p *connectionPool) executeWithContext(ctx context.Context, query string, envData string, outputFormat string) (string, error) {
+	conn, err := p.acquire(ctx)
 	if err != nil {
 		return "", err
 	}
-	return string(respBytes), nil
+
+	result, err := conn.execute(ctx, query, envData, outputFormat)
+	if ctx.Err() != nil {
+		if killErr := conn.kill(); killErr != nil {
+			log.Printf("warning: error killing timed-out worker: %s", killErr.Error())
+		}
+		go p.replace(conn)
+		return "", ctx.Err()
+	}
+	p.release(conn, connectionHealthy(err))
+	return result, err
 }
 
 func (s *server) handleRoot(w http.ResponseWriter, r *http.Request) {
@@ -207,19 +716,32 @@ func (s *server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := s.executeAndRender(w, tutorialQuery, tutorialData)
+	ctx, cancel := context.WithTimeout(r.Context(), s.queryTimeout)
+	defer cancel()
+	err := s.executeAndRender(ctx, w, tutorialQuery, tutorialData, defaultOutputFormat, r.RemoteAddr)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+// wantsJSON reports whether r should get a JSON response instead of the
+// rendered HTML page: either it was sent to apiExecutePath directly, or it
+// asked for application/json via the Accept header.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Path == apiExecutePath || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
 func (s *server) handleExecute(w http.ResponseWriter, r *http.Request) {
 	log.Printf("handleExecute %s %s", r.Method, r.URL.String())
 	if r.Method != http.MethodPost {
 		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
 		return
 	}
+	if wantsJSON(r) {
+		s.handleExecuteJSON(w, r)
+		return
+	}
 	err := s.handleExecuteErr(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -228,9 +750,48 @@ func (s *server) handleExecute(w http.ResponseWriter, r *http.Request) {
 }
 
 type server struct {
-	classpath  string
-	jarPath    string
-	connection *javaServerConnection
+	classpath           string
+	jarPath             string
+	pool                *connectionPool
+	queryTimeout        time.Duration
+	maxRequestBodyBytes int64
+	history             *history.Store
+}
+
+// executionResult is the outcome of running a single query, independent of
+// whether the caller wants it rendered as HTML or marshalled as JSON.
+type executionResult struct {
+	output   string
+	duration time.Duration
+}
+
+// execute runs query against envData using whichever backend the server was
+// configured with, and records metrics for it. It has no knowledge of HTTP;
+// handleExecuteErr (HTML) and handleExecuteJSON (JSON) both build their
+// response on top of it.
+func (s *server) execute(ctx context.Context, query string, envData string, outputFormat string) (executionResult, error) {
+	queryBytes.Observe(float64(len(query)))
+	environmentBytes.Observe(float64(len(envData)))
+	queriesInFlight.Inc()
+	defer queriesInFlight.Dec()
+
+	start := time.Now()
+	var result string
+	var err error
+	if s.pool != nil {
+		result, err = s.pool.executeWithContext(ctx, query, envData, outputFormat)
+	} else if s.jarPath != "" {
+		result, err = executeNewCLI(ctx, s.jarPath, query, envData, outputFormat)
+	} else {
+		result, err = executeOriginalCLI(ctx, s.classpath, query, envData, outputFormat)
+	}
+	duration := time.Since(start)
+	queriesTotal.WithLabelValues(classifyError(err)).Inc()
+	queryDuration.Observe(duration.Seconds())
+	if err != nil {
+		queriesFailedTotal.Inc()
+	}
+	return executionResult{result, duration}, err
 }
 
 func (s *server) handleExecuteErr(w http.ResponseWriter, r *http.Request) error {
@@ -244,46 +805,311 @@ func (s *server) handleExecuteErr(w http.ResponseWriter, r *http.Request) error
 	if queryData == "" || envData == "" {
 		return fmt.Errorf("query and environment must not be empty")
 	}
+	outputFormat := r.FormValue(outputFormatFormID)
+	if outputFormat == "" {
+		outputFormat = defaultOutputFormat
+	}
 
-	return s.executeAndRender(w, queryData, envData)
+	ctx, cancel := context.WithTimeout(r.Context(), s.queryTimeout)
+	defer cancel()
+	return s.executeAndRender(ctx, w, queryData, envData, outputFormat, r.RemoteAddr)
 }
 
-func (s *server) executeAndRender(w http.ResponseWriter, query string, envData string) error {
-	start := time.Now()
-	var result string
-	var err error
-	if s.connection != nil {
-		result, err = s.connection.execute(query, envData)
-		if err != nil {
-			// reset the connection
-			closeErr := s.connection.close()
-			if closeErr != nil {
-				log.Printf("warning: error closing server: %s", closeErr.Error())
-			}
-			s.connection, closeErr = newJavaServerConnection(s.jarPath)
-			if closeErr != nil {
-				log.Printf("warning: error starting server: %s", closeErr.Error())
-			}
+func (s *server) executeAndRender(ctx context.Context, w http.ResponseWriter, query string, envData string, outputFormat string, remoteAddr string) error {
+	result, err := s.execute(ctx, query, envData, outputFormat)
+	output := result.output
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			log.Printf("query did not finish within %s: %s", s.queryTimeout, ctxErr)
+			output = fmt.Sprintf("query did not complete within %s and was cancelled", s.queryTimeout)
+		} else {
+			return err
 		}
-	} else if s.jarPath != "" {
-		result, err = executeNewCLI(s.jarPath, query, envData)
-	} else {
-		result, err = executeOriginalCLI(s.classpath, query, envData)
 	}
-	if err != nil {
-		return err
+	if err == nil && s.history != nil {
+		s.recordHistory(ctx, query, envData, output, result.duration, remoteAddr)
 	}
-	end := time.Now()
-	log.Printf("executed query in %s", end.Sub(start).String())
+	log.Printf("executed query in %s", result.duration.String())
 
-	values := &rootTemplateValues{query, envData, result}
+	values := &rootTemplateValues{query, envData, output, outputFormat, supportedOutputFormats, contentTypeForOutputFormat(outputFormat)}
 	return rootTemplate.Execute(w, values)
 }
 
+// recordHistory saves a successful execution to s.history. Failures are
+// logged rather than surfaced to the caller: a broken history database
+// shouldn't take down query execution.
+func (s *server) recordHistory(ctx context.Context, query, envData, output string, duration time.Duration, remoteAddr string) {
+	entry := history.Entry{
+		Query:       query,
+		Environment: envData,
+		Result:      output,
+		ElapsedMs:   duration.Milliseconds(),
+		RemoteAddr:  remoteAddr,
+		CreatedAt:   time.Now(),
+	}
+	if _, err := s.history.Record(ctx, entry); err != nil {
+		log.Printf("failed to record history entry: %s", err)
+	}
+}
+
+type apiExecuteRequest struct {
+	Query       string `json:"query"`
+	Environment string `json:"environment"`
+}
+
+type apiExecuteResponse struct {
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// handleExecuteJSON is the apiExecutePath / Accept:application/json counterpart
+// of handleExecuteErr: same s.execute call, but driven by and responding with
+// JSON so curl/notebooks/etc. can use the demo without scraping HTML.
+func (s *server) handleExecuteJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestBodyBytes)
+	var req apiExecuteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		status := http.StatusBadRequest
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(apiExecuteResponse{Error: err.Error()})
+		return
+	}
+	if req.Query == "" || req.Environment == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(apiExecuteResponse{Error: "query and environment must not be empty"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.queryTimeout)
+	defer cancel()
+	result, err := s.execute(ctx, req.Query, req.Environment, defaultOutputFormat)
+	resp := apiExecuteResponse{Result: result.output, DurationMs: result.duration.Milliseconds()}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// executeJSONRequest/executeJSONResponse back executeJSONPath. Unlike
+// apiExecuteRequest/apiExecuteResponse (the older Accept:application/json
+// contract on apiExecutePath), this endpoint exposes outputFormat and uses
+// the field names agreed with the tooling that scripts against it.
+type executeJSONRequest struct {
+	Query        string `json:"query"`
+	Environment  string `json:"environment"`
+	OutputFormat string `json:"format"`
+}
+
+type executeJSONResponse struct {
+	Result    string `json:"result,omitempty"`
+	Format    string `json:"format"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleExecuteJSONFormat serves executeJSONPath so the demo can be driven
+// programmatically without scraping HTML, with the requested outputFormat
+// reported back. The response is always application/json; the result in the
+// requested format is the string in its "result" field.
+func (s *server) handleExecuteJSONFormat(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestBodyBytes)
+	var req executeJSONRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		status := http.StatusBadRequest
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(executeJSONResponse{Error: err.Error()})
+		return
+	}
+	if req.Query == "" || req.Environment == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(executeJSONResponse{Error: "query and environment must not be empty"})
+		return
+	}
+	outputFormat := req.OutputFormat
+	if outputFormat == "" {
+		outputFormat = defaultOutputFormat
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.queryTimeout)
+	defer cancel()
+	result, err := s.execute(ctx, req.Query, req.Environment, outputFormat)
+	resp := executeJSONResponse{Result: result.output, Format: outputFormat, ElapsedMs: result.duration.Milliseconds()}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// historyPath is the permalink prefix for re-populating the form with a past
+// execution: historyPath + "5" shows entry 5.
+const historyPath = "/q/"
+
+// defaultHistoryListLimit bounds /history and GET /api/history when the
+// caller doesn't specify a limit.
+const defaultHistoryListLimit = 50
+
+// handleHistoryPage lists the most recent history entries with permalinks to
+// historyPath.
+func (s *server) handleHistoryPage(w http.ResponseWriter, r *http.Request) {
+	if s.history == nil {
+		http.NotFound(w, r)
+		return
+	}
+	entries, err := s.history.List(r.Context(), defaultHistoryListLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := historyTemplate.Execute(w, entries); err != nil {
+		log.Printf("failed to render history page: %s", err)
+	}
+}
+
+// handleQueryPermalink serves historyPath/<id>: it re-renders the root form
+// populated with the recorded query, environment, and result, without
+// re-executing anything.
+func (s *server) handleQueryPermalink(w http.ResponseWriter, r *http.Request) {
+	if s.history == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, historyPath), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid history id", http.StatusBadRequest)
+		return
+	}
+	entry, err := s.history.Get(r.Context(), id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	values := &rootTemplateValues{
+		entry.Query, entry.Environment, entry.Result,
+		defaultOutputFormat, supportedOutputFormats, contentTypeForOutputFormat(defaultOutputFormat),
+	}
+	if err := rootTemplate.Execute(w, values); err != nil {
+		log.Printf("failed to render permalink %s%d: %s", historyPath, id, err)
+	}
+}
+
+// handleAPIHistoryList serves GET /api/history?limit=N: the JSON list of
+// recent entries backing the REST surface alongside the HTML /history page.
+func (s *server) handleAPIHistoryList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultHistoryListLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid limit"})
+			return
+		}
+		limit = parsed
+	}
+	entries, err := s.history.List(r.Context(), limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleAPIHistoryItem serves DELETE /api/history/<id>.
+func (s *server) handleAPIHistoryItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/history/"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid history id"})
+		return
+	}
+	if err := s.history.Delete(r.Context(), id); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiSavedRequest is the POST /api/saved body: it marks an existing history
+// entry as saved (exempting it from size-cap trimming) under name.
+type apiSavedRequest struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// handleAPISaved serves POST /api/saved.
+func (s *server) handleAPISaved(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req apiSavedRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "name must not be empty"})
+		return
+	}
+	if err := s.history.Save(r.Context(), req.ID, req.Name); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *server) makeHandlers() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handleRoot)
 	mux.HandleFunc(executePath, s.handleExecute)
+	mux.HandleFunc(apiExecutePath, s.handleExecute)
+	mux.HandleFunc(executeJSONPath, s.handleExecuteJSONFormat)
+	mux.HandleFunc("/history", s.handleHistoryPage)
+	mux.HandleFunc(historyPath, s.handleQueryPermalink)
+	mux.HandleFunc("/api/history", s.handleAPIHistoryList)
+	mux.HandleFunc("/api/history/", s.handleAPIHistoryItem)
+	mux.HandleFunc("/api/saved", s.handleAPISaved)
+	mux.Handle("/metrics", promhttp.Handler())
 	return mux
 }
 
@@ -298,6 +1124,11 @@ func main() {
 	jarPath := flag.String("jar", "", "path to jar for the new CLI")
 	addr := flag.String("addr", "", "If set, address for HTTP requests.")
 	noServer := flag.Bool("noServer", false, "Do not use the JAR server mode.")
+	workers := flag.Int("workers", runtime.GOMAXPROCS(0), "number of persistent PartiQL JVM workers to pool in server mode")
+	queryTimeout := flag.Duration("queryTimeout", defaultQueryTimeout, "maximum time a single query may run before it is killed")
+	maxRequestBodyBytes := flag.Int64("maxRequestBodyBytes", defaultMaxRequestBodyBytes, "maximum size of a /api/execute JSON request body")
+	historyDB := flag.String("historyDB", "", "path to a SQLite database for recording query history; empty disables history")
+	historyMaxRows := flag.Int("historyMaxRows", defaultHistoryMaxRows, "maximum number of un-saved history rows to keep")
 	flag.Parse()
 
 	if *addr == "" && os.Getenv(portEnvVar) != "" {
@@ -306,16 +1137,25 @@ func main() {
 		*addr = ":" + defaultPort
 	}
 
-	var connection *javaServerConnection
+	var pool *connectionPool
 	var err error
 	if *jarPath != "" && !*noServer {
-		connection, err = newJavaServerConnection(*jarPath)
+		pool, err = newConnectionPool(*jarPath, *workers)
 		if err != nil {
 			panic(err)
 		}
 	}
 
-	s := &server{*classpath, *jarPath, connection}
+	var historyStore *history.Store
+	if *historyDB != "" {
+		historyStore, err = history.Open(*historyDB, *historyMaxRows)
+		if err != nil {
+			panic(err)
+		}
+		defer historyStore.Close()
+	}
+
+	s := &server{*classpath, *jarPath, pool, *queryTimeout, *maxRequestBodyBytes, historyStore}
 	err = s.serveHTTP(*addr)
 	if err != nil {
 		panic(err)
@@ -323,9 +1163,12 @@ func main() {
 }
 
 type rootTemplateValues struct {
-	Query   string
-	Data    string
-	Results string
+	Query         string
+	Data          string
+	Results       string
+	OutputFormat  string
+	OutputFormats []string
+	ContentType   string
 }
 
 var rootTemplate = template.Must(template.New("root").Parse(`<!doctype html>
@@ -339,15 +1182,22 @@ textarea {
 </head>
 <body>
 <h1>PartiQL Explorer</h1>
-<p>Execute <a href="https://partiql.org/">PartiQL</a> queries. See the <a href="https://partiql.org/tutorial.html">tutorial</a> for example queries.</p>
+<p>Execute <a href="https://partiql.org/">PartiQL</a> queries. See the <a href="https://partiql.org/tutorial.html">tutorial</a> for example queries. See <a href="/history">recent queries</a>.</p>
 
 <form method="post" action="` + executePath + `">
 <h2>Query</h2>
 <textarea name="` + queryFormID + `" rows="10" cols="120" autofocus>{{.Query}}</textarea>
+
+<h2>Output format</h2>
+<select name="` + outputFormatFormID + `">
+{{$selected := .OutputFormat}}
+{{range .OutputFormats}}<option value="{{.}}"{{if eq . $selected}} selected{{end}}>{{.}}</option>
+{{end}}</select>
 <p><input type="submit" value="Execute"></p>
 
 <h2>Results</h2>
 <pre>{{.Results}}</pre>
+<p><a href="data:{{.ContentType}};charset=utf-8,{{urlquery .Results}}" download="result.{{.OutputFormat}}">download results</a></p>
 
 <h2>Data</h2>
 <textarea name="` + envFormID + `" rows="10" cols="120">{{.Data}}</textarea>
@@ -356,6 +1206,27 @@ textarea {
 </html>
 `))
 
+// historyTemplate renders the /history page from a []history.Entry, newest
+// first (the order Store.List already returns them in).
+var historyTemplate = template.Must(template.New("history").Parse(`<!doctype html>
+<html>
+<head><title>PartiQL Explorer - History</title></head>
+<body>
+<h1>History</h1>
+<p><a href="/">back to query form</a></p>
+<table border="1" cellpadding="4">
+<tr><th>When</th><th>Query</th><th>Elapsed</th><th>Saved</th></tr>
+{{range .}}<tr>
+<td>{{.CreatedAt.Format "2006-01-02 15:04:05"}}</td>
+<td><a href="` + historyPath + `{{.ID}}">{{.Query}}</a></td>
+<td>{{.ElapsedMs}}ms</td>
+<td>{{if .Saved}}{{.Name}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
 const tutorialQuery = `-- query from the PartiQL tutorial
 SELECT e.name AS employeeName, 
        e.project.name AS projectName
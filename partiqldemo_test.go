@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// newPipeConnection wires up a javaServerConnection to a pair of os.Pipes
+// instead of a real JVM subprocess, so send/readLoop can be exercised
+// directly. The returned serverRead/serverWrite are the fake JVM's ends: it
+// reads jsonRequest lines from serverRead and writes jsonResponse lines to
+// serverWrite.
+func newPipeConnection(t *testing.T) (j *javaServerConnection, serverRead io.ReadCloser, serverWrite io.WriteCloser) {
+	t.Helper()
+	serverRead, clientWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientRead, serverWrite, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	j = &javaServerConnection{
+		fromProcess: clientRead,
+		toProcess:   clientWrite,
+		pending:     make(map[int64]chan jsonResponse),
+	}
+	go j.readLoop()
+	t.Cleanup(func() {
+		serverRead.Close()
+		serverWrite.Close()
+	})
+	return j, serverRead, serverWrite
+}
+
+func writeResponse(t *testing.T, w io.Writer, resp jsonResponse) {
+	t.Helper()
+	line, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = append(line, '\n')
+	if _, err := w.Write(line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJavaServerConnectionSendRoundTrip(t *testing.T) {
+	j, serverRead, serverWrite := newPipeConnection(t)
+
+	go func() {
+		scanner := bufio.NewScanner(serverRead)
+		for scanner.Scan() {
+			var req jsonRequest
+			if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+				return
+			}
+			writeResponse(t, serverWrite, jsonResponse{ID: req.ID, OK: true, Result: "echo:" + req.Query})
+		}
+	}()
+
+	resp, err := j.send(context.Background(), jsonRequest{ID: 1, Query: "SELECT 1"})
+	if err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	if resp.Result != "echo:SELECT 1" {
+		t.Errorf("resp.Result = %q, want %q", resp.Result, "echo:SELECT 1")
+	}
+}
+
+func TestJavaServerConnectionExecuteReportsPartiqlError(t *testing.T) {
+	j, serverRead, serverWrite := newPipeConnection(t)
+
+	go func() {
+		scanner := bufio.NewScanner(serverRead)
+		for scanner.Scan() {
+			var req jsonRequest
+			if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+				return
+			}
+			writeResponse(t, serverWrite, jsonResponse{ID: req.ID, OK: false, Stage: "parse", Error: "bad syntax"})
+		}
+	}()
+
+	_, err := j.execute(context.Background(), "not sql", "", "")
+	var perr *partiqlError
+	if !errors.As(err, &perr) {
+		t.Fatalf("execute err = %v, want a *partiqlError", err)
+	}
+	if !connectionHealthy(err) {
+		t.Error("connectionHealthy(partiqlError) = false, want true")
+	}
+}
+
+// TestJavaServerConnectionSendCleansUpPendingOnCancel is a regression test:
+// send used to leave a stale j.pending entry behind when ctx was canceled
+// while waiting for the response (as opposed to while the write itself was
+// blocked). A leaked entry could be handed a reply from a later, unrelated
+// request with the same id.
+func TestJavaServerConnectionSendCleansUpPendingOnCancel(t *testing.T) {
+	j, serverRead, _ := newPipeConnection(t)
+
+	received := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(serverRead)
+		scanner.Scan() // read the request, then never reply
+		close(received)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := j.send(ctx, jsonRequest{ID: 7, Query: "slow"})
+		errCh <- err
+	}()
+
+	<-received
+	cancel()
+
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("send err = %v, want context.Canceled", err)
+	}
+
+	j.mu.Lock()
+	_, stillPending := j.pending[7]
+	j.mu.Unlock()
+	if stillPending {
+		t.Error("j.pending[7] still set after send's wait was canceled")
+	}
+}